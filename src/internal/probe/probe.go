@@ -0,0 +1,113 @@
+// Package probe inspects audio files with ffprobe to decide whether they
+// can be concatenated without re-encoding.
+package probe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+// StreamInfo describes the properties of an audio file's primary stream
+// that must match across inputs for a stream-copy concat to be valid.
+type StreamInfo struct {
+	CodecName     string
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+}
+
+// ProbeStream runs ffprobe against path and returns the codec, sample rate,
+// channel count, and bit depth of its first audio stream.
+func ProbeStream(ctx context.Context, path string) (StreamInfo, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "a:0", "-show_streams", "-of", "json", path)
+	out, err := cmd.Output()
+	if err != nil {
+		return StreamInfo{}, fmt.Errorf("ffprobe failed for %s: %w", path, err)
+	}
+
+	var probeOut struct {
+		Streams []struct {
+			CodecName        string `json:"codec_name"`
+			SampleRate       string `json:"sample_rate"`
+			Channels         int    `json:"channels"`
+			BitsPerSample    int    `json:"bits_per_sample"`
+			BitsPerRawSample string `json:"bits_per_raw_sample"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &probeOut); err != nil {
+		return StreamInfo{}, fmt.Errorf("failed to parse ffprobe output for %s: %w", path, err)
+	}
+	if len(probeOut.Streams) == 0 {
+		return StreamInfo{}, fmt.Errorf("no audio stream found in %s", path)
+	}
+
+	stream := probeOut.Streams[0]
+	sampleRate, err := strconv.Atoi(stream.SampleRate)
+	if err != nil {
+		return StreamInfo{}, fmt.Errorf("failed to parse sample rate for %s: %w", path, err)
+	}
+
+	bitsPerSample := stream.BitsPerSample
+	if bitsPerSample == 0 {
+		// Some codecs (e.g. lossy ones) only report bits_per_raw_sample.
+		bitsPerSample, _ = strconv.Atoi(stream.BitsPerRawSample)
+	}
+
+	return StreamInfo{
+		CodecName:     stream.CodecName,
+		SampleRate:    sampleRate,
+		Channels:      stream.Channels,
+		BitsPerSample: bitsPerSample,
+	}, nil
+}
+
+// ProbeTags returns the container-level metadata tags (title, artist,
+// album, ...) attached to the file at path.
+func ProbeTags(ctx context.Context, path string) (map[string]string, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_format", "-of", "json", path)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed for %s: %w", path, err)
+	}
+
+	var probeOut struct {
+		Format struct {
+			Tags map[string]string `json:"tags"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &probeOut); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output for %s: %w", path, err)
+	}
+
+	return probeOut.Format.Tags, nil
+}
+
+// ProbeDurationUs returns the duration of the media at path, in
+// microseconds, as reported by ffprobe's container-level "format.duration"
+// field.
+func ProbeDurationUs(ctx context.Context, path string) (int64, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_format", "-show_streams", "-of", "json", path)
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe failed for %s: %w", path, err)
+	}
+
+	var probeOut struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &probeOut); err != nil {
+		return 0, fmt.Errorf("failed to parse ffprobe output for %s: %w", path, err)
+	}
+
+	seconds, err := strconv.ParseFloat(probeOut.Format.Duration, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse duration for %s: %w", path, err)
+	}
+
+	return int64(seconds * 1_000_000), nil
+}
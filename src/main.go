@@ -1,24 +1,35 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"runtime"
 	"strings"
-	"time"
 
 	"github.com/schollz/progressbar/v3"
 	"github.com/sirupsen/logrus"
+
+	"github.com/walker84837/aconcat/pkg/aconcat"
 )
 
 var (
-	verbose    = flag.Bool("verbose", false, "Enable verbose logging")
-	outputFile = flag.String("output", "", "Output audio file (required)")
-	sampleRate = flag.Int("sample-rate", 48000, "Sample rate for re-encoding (default: 48000)")
-	helpFlag   = flag.Bool("help", false, "Show usage information")
+	verbose       = flag.Bool("verbose", false, "Enable verbose logging")
+	outputFile    = flag.String("output", "", "Output audio file (required)")
+	sampleRate    = flag.Int("sample-rate", 48000, "Sample rate for re-encoding (default: 48000)")
+	jobs          = flag.Int("jobs", runtime.NumCPU(), "Number of files to re-encode concurrently")
+	forceReencode = flag.Bool("force-reencode", false, "Re-encode every input even if they already share a compatible stream layout")
+	title         = flag.String("title", "", "Title tag to embed in the output file")
+	artist        = flag.String("artist", "", "Artist tag to embed in the output file")
+	album         = flag.String("album", "", "Album tag to embed in the output file")
+	cover         = flag.String("cover", "", "Image file to embed as cover art in the output file")
+	metadataFrom  = flag.String("metadata-from", "", "Copy metadata tags from this input file onto the output")
+	chaptersFlag  = flag.Bool("chapters", false, "Add one chapter per input file boundary")
+	chapterTitles = flag.String("chapter-titles", "", "Comma-separated file=Title pairs overriding chapter titles (e.g. file1.mp3=Intro,file2.mp3=Verse)")
+	crossfade     = flag.Duration("crossfade", 0, "Crossfade duration between consecutive inputs (e.g. 2s); forces re-encoding")
+	normalize     = flag.Bool("normalize", false, "Apply two-pass EBU R128 loudness normalization to each input; forces re-encoding")
+	helpFlag      = flag.Bool("help", false, "Show usage information")
 )
 
 func usage() {
@@ -31,6 +42,17 @@ Options:
   -verbose        Enable verbose logging
   -output         Specify the output audio file (required)
   -sample-rate    Set the sample rate for re-encoding (default: 48000)
+  -jobs           Number of files to re-encode concurrently (default: number of CPUs)
+  -force-reencode Re-encode every input even if they already share a compatible stream layout
+  -title          Title tag to embed in the output file
+  -artist         Artist tag to embed in the output file
+  -album          Album tag to embed in the output file
+  -cover          Image file to embed as cover art in the output file
+  -metadata-from  Copy metadata tags from this input file onto the output
+  -chapters       Add one chapter per input file boundary
+  -chapter-titles Comma-separated file=Title pairs overriding chapter titles
+  -crossfade      Crossfade duration between consecutive inputs (e.g. 2s); forces re-encoding
+  -normalize      Apply two-pass EBU R128 loudness normalization to each input; forces re-encoding
   -help           Show this help message
 
 Examples:
@@ -38,6 +60,72 @@ Examples:
   aconcat -sample-rate 44100 -output final.flac file1.aac file2.ogg`)
 }
 
+// parseChapterTitles parses a "file1=TitleA,file2=TitleB" spec as passed to
+// -chapter-titles into a lookup from input path to chapter title.
+func parseChapterTitles(spec string) map[string]string {
+	titles := map[string]string{}
+	if spec == "" {
+		return titles
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		file, title, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		titles[file] = title
+	}
+	return titles
+}
+
+// newProgressHandler returns an aconcat.Event callback that renders each
+// phase as a progressbar.ProgressBar: file-count based for "reencode", and
+// time based (via BytesWritten) for "concat" and "convert".
+func newProgressHandler() func(aconcat.Event) {
+	var bar *progressbar.ProgressBar
+
+	return func(e aconcat.Event) {
+		switch e.Type {
+		case aconcat.PhaseStart:
+			switch {
+			case e.Total <= 0:
+				bar = progressbar.NewOptions64(-1,
+					progressbar.OptionSetWidth(20),
+					progressbar.OptionSetDescription(e.Phase),
+					progressbar.OptionSpinnerType(14))
+			case e.Phase == "reencode":
+				// File-count based: Total is the number of inputs.
+				bar = progressbar.NewOptions64(e.Total,
+					progressbar.OptionSetWidth(20),
+					progressbar.OptionSetDescription(e.Phase))
+			default:
+				// Time based: Total is the phase's duration in microseconds,
+				// scaled to a 0-100 bar by BytesWritten events.
+				bar = progressbar.NewOptions64(100,
+					progressbar.OptionSetWidth(20),
+					progressbar.OptionSetDescription(e.Phase))
+			}
+		case aconcat.FileDone:
+			if bar == nil {
+				return
+			}
+			if e.Phase == "reencode" {
+				bar.Describe(fmt.Sprintf("Re-encoded %s", e.File))
+				bar.Add(1)
+			} else {
+				bar.Finish()
+			}
+		case aconcat.BytesWritten:
+			// The reencode phase's bar is file-count based (workers run
+			// concurrently, so their individual time-based progress doesn't
+			// map onto one bar); only "concat" and "convert" scale off this.
+			if bar == nil || e.Total <= 0 || e.Phase == "reencode" {
+				return
+			}
+			bar.Set64(e.Current * 100 / e.Total)
+		}
+	}
+}
+
 func main() {
 	flag.Usage = usage
 	flag.Parse()
@@ -62,117 +150,28 @@ func main() {
 		logger.SetLevel(logrus.WarnLevel)
 	}
 
-	// Directory for storing re-encoded files
-	tempDir := filepath.Join(os.TempDir(), "audio_concat")
-	err := os.MkdirAll(tempDir, 0755)
-	if err != nil {
-		logger.Fatalf("Failed to create temporary directory: %v", err)
+	concatenator := &aconcat.Concatenator{
+		SampleRate:    *sampleRate,
+		Channels:      2,
+		Codec:         "flac",
+		Jobs:          *jobs,
+		ForceReencode: *forceReencode,
+		Title:         *title,
+		Artist:        *artist,
+		Album:         *album,
+		Cover:         *cover,
+		MetadataFrom:  *metadataFrom,
+		Chapters:      *chaptersFlag,
+		ChapterTitles: parseChapterTitles(*chapterTitles),
+		Crossfade:     *crossfade,
+		Normalize:     *normalize,
+		Logger:        logger,
+		Progress:      newProgressHandler(),
 	}
-	defer os.RemoveAll(tempDir)
-
-	var convertedFiles []string
-
-	// Re-encode input files to a common format and codec
-	for _, inputFile := range inputFiles {
-		absPath, err := filepath.Abs(inputFile)
-		if err != nil {
-			logger.Fatalf("Failed to get absolute path for %s: %v", inputFile, err)
-		}
 
-		convertedFile := filepath.Join(tempDir, filepath.Base(absPath)+"_converted.flac")
-		logger.Infof("Re-encoding %s to %s", absPath, convertedFile)
-
-		// Use the sample rate from the flag
-		cmd := exec.Command("ffmpeg", "-i", absPath, "-ar", fmt.Sprintf("%d", *sampleRate), "-ac", "2", "-c:a", "flac", convertedFile)
-
-		if !*verbose {
-			cmd.Stdout = io.Discard
-			cmd.Stderr = io.Discard
-		}
-
-		err = cmd.Run()
-		if err != nil {
-			logger.Fatalf("ffmpeg failed to re-encode %s: %v", absPath, err)
-		}
-
-		convertedFiles = append(convertedFiles, convertedFile)
-	}
-
-	// Create a temporary file for the concatenation list
-	logger.Info("Creating temporary file for concatenation list.")
-	listFile, err := os.CreateTemp("", "concat-list-*.txt")
-	if err != nil {
-		logger.Fatalf("Failed to create temporary file: %v", err)
-	}
-	defer os.Remove(listFile.Name())
-	logger.Infof("Temporary file created at: %s", listFile.Name())
-
-	// Write re-encoded files to the temporary file
-	for _, file := range convertedFiles {
-		_, err := fmt.Fprintf(listFile, "file '%s'\n", file)
-		if err != nil {
-			logger.Fatalf("Failed to write to temporary file list: %v", err)
-		}
+	if err := concatenator.Run(context.Background(), inputFiles, *outputFile); err != nil {
+		logger.Fatalf("%v", err)
 	}
 
-	// Print out the content of the temporary file for verification
-	listFile.Seek(0, io.SeekStart)
-	content, err := io.ReadAll(listFile)
-	if err != nil {
-		logger.Fatalf("Failed to read temporary file: %v", err)
-	}
-	logger.Infof("Temporary file content:\n%s", content)
-
-	// Run ffmpeg to concatenate re-encoded files
-	logger.Info("Running ffmpeg to concatenate files.")
-	flacFile := strings.TrimSuffix(*outputFile, filepath.Ext(*outputFile)) + ".flac"
-	cmd := exec.Command("ffmpeg", "-f", "concat", "-safe", "0", "-i", listFile.Name(), "-c", "copy", flacFile)
-
-	if !*verbose {
-		cmd.Stdout = io.Discard
-		cmd.Stderr = io.Discard
-	}
-
-	// Create a progress bar
-	progressBar := progressbar.NewOptions(100,
-		progressbar.OptionSetWidth(20),
-		progressbar.OptionShowBytes(true),
-		progressbar.OptionSetDescription("Processing"))
-
-	// Simulate progress update
-	go func() {
-		for i := 0; i < 100; i++ {
-			if !*verbose {
-				progressBar.Add(1)
-				time.Sleep(50 * time.Millisecond)
-			}
-		}
-	}()
-
-	err = cmd.Run()
-	if err != nil {
-		logger.Fatalf("ffmpeg failed with error: %v", err)
-	}
-
-	logger.Infof("Concatenation of audio files is successful! Output file: %s", flacFile)
-
-	// Check the extension of the output file
-	if strings.ToLower(filepath.Ext(*outputFile)) != ".flac" {
-		// Re-encode to the desired output format
-		finalOutput := *outputFile
-		logger.Infof("Re-encoding %s to %s", flacFile, finalOutput)
-		cmd = exec.Command("ffmpeg", "-i", flacFile, finalOutput)
-
-		if !*verbose {
-			cmd.Stdout = io.Discard
-			cmd.Stderr = io.Discard
-		}
-
-		err = cmd.Run()
-		if err != nil {
-			logger.Fatalf("ffmpeg failed to re-encode to %s: %v", finalOutput, err)
-		}
-		logger.Infof("Re-encoding to %s successful!", finalOutput)
-		os.Remove(flacFile)
-	}
+	logger.Infof("Concatenation of audio files is successful! Output file: %s", *outputFile)
 }
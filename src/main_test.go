@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseChapterTitles(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		want map[string]string
+	}{
+		{
+			name: "empty spec",
+			spec: "",
+			want: map[string]string{},
+		},
+		{
+			name: "single pair",
+			spec: "file1.mp3=Intro",
+			want: map[string]string{"file1.mp3": "Intro"},
+		},
+		{
+			name: "multiple pairs",
+			spec: "file1.mp3=Intro,file2.wav=Verse",
+			want: map[string]string{"file1.mp3": "Intro", "file2.wav": "Verse"},
+		},
+		{
+			name: "pair missing equals is skipped",
+			spec: "file1.mp3=Intro,file2.wav",
+			want: map[string]string{"file1.mp3": "Intro"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseChapterTitles(tt.spec)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseChapterTitles(%q) = %v, want %v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
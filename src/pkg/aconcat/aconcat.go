@@ -0,0 +1,616 @@
+// Package aconcat re-encodes and concatenates audio files into a single
+// output, optionally skipping inputs that already share a compatible
+// stream layout, tagging the result, and adding chapter markers. It is the
+// library underlying the aconcat CLI; callers embedding it (GUIs, other
+// tools) drive it through the Concatenator type instead of flags.
+package aconcat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/walker84837/aconcat/internal/probe"
+)
+
+// EventType identifies the kind of progress event emitted through
+// Concatenator.Progress.
+type EventType string
+
+const (
+	// PhaseStart marks the beginning of a phase ("reencode", "concat", or
+	// "convert") and reports the phase's scale in Total: the number of
+	// inputs for "reencode", or the media duration in microseconds for
+	// "concat" and "convert" (0 when it is unknown).
+	PhaseStart EventType = "phase_start"
+	// FileDone marks the completion of one input file within a phase.
+	FileDone EventType = "file_done"
+	// BytesWritten reports progress within a single ffmpeg invocation, as
+	// microseconds of media processed (Current) against that invocation's
+	// duration in microseconds (Total). During "reencode" each file's
+	// events carry that file's own duration, not the phase's file count.
+	BytesWritten EventType = "bytes_written"
+)
+
+// Event is a structured progress notification. Callers render their own
+// progress bars from it instead of depending on a specific UI library.
+type Event struct {
+	Type    EventType
+	Phase   string
+	File    string
+	Total   int64
+	Current int64
+}
+
+// Concatenator re-encodes and concatenates audio files. Every exec.Command
+// it runs is tied to the context passed to its methods, so canceling that
+// context kills any in-flight ffmpeg processes.
+type Concatenator struct {
+	SampleRate int    // target sample rate for re-encoded inputs; 0 means 48000
+	Channels   int    // target channel count for re-encoded inputs; 0 means 2
+	Codec      string // target audio codec for re-encoded inputs; "" means "flac"
+
+	Jobs          int  // concurrent re-encode workers; 0 means 1
+	ForceReencode bool // re-encode every input even if they already match
+
+	Crossfade time.Duration // crossfade duration between consecutive inputs; 0 disables
+	Normalize bool          // two-pass EBU R128 loudness normalization per input
+
+	Title         string
+	Artist        string
+	Album         string
+	Cover         string            // image to embed as cover art
+	MetadataFrom  string            // input to copy tags from
+	Chapters      bool              // add one chapter per input boundary
+	ChapterTitles map[string]string // input path -> chapter title override
+
+	Logger   *logrus.Logger
+	Progress func(Event)
+
+	tempDir string // set by ReencodeAll, removed by Cleanup
+}
+
+// Cleanup removes the temporary directory ReencodeAll created for
+// re-encoded files, if any. Run calls this automatically; callers driving
+// ReencodeAll and Concat directly should call it once they're done with
+// the returned file list.
+func (c *Concatenator) Cleanup() error {
+	if c.tempDir == "" {
+		return nil
+	}
+	err := os.RemoveAll(c.tempDir)
+	c.tempDir = ""
+	return err
+}
+
+func (c *Concatenator) logger() *logrus.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return logrus.StandardLogger()
+}
+
+func (c *Concatenator) emit(e Event) {
+	if c.Progress != nil {
+		c.Progress(e)
+	}
+}
+
+func (c *Concatenator) sampleRate() int {
+	if c.SampleRate == 0 {
+		return 48000
+	}
+	return c.SampleRate
+}
+
+func (c *Concatenator) channels() int {
+	if c.Channels == 0 {
+		return 2
+	}
+	return c.Channels
+}
+
+func (c *Concatenator) codec() string {
+	if c.Codec == "" {
+		return "flac"
+	}
+	return c.Codec
+}
+
+// runFFmpeg runs ffmpeg with "-progress pipe:1 -nostats" inserted before
+// args (right after the program name), parses the key=value progress lines
+// on stdout, and emits BytesWritten events scaled against totalUs, followed
+// by a FileDone event once ffmpeg exits successfully. It backs the
+// re-encode, concat, and convert invocations, including the concurrent
+// per-file re-encode workers in ReencodeAll, each reporting progress
+// against its own probed duration; the loudnorm measurement pass and the
+// metadata remux run ffmpeg directly and report no progress.
+func (c *Concatenator) runFFmpeg(ctx context.Context, phase, file string, totalUs int64, args []string) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Args = append([]string{cmd.Args[0], "-progress", "pipe:1", "-nostats"}, cmd.Args[1:]...)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to attach stdout pipe: %w", err)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || key != "out_time_ms" {
+			continue
+		}
+		// Despite its name, ffmpeg reports out_time_ms in microseconds.
+		outTimeUs, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		c.emit(Event{Type: BytesWritten, Phase: phase, File: file, Total: totalUs, Current: outTimeUs})
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	c.emit(Event{Type: FileDone, Phase: phase, File: file})
+	return nil
+}
+
+// streamCopyTargets probes every input against the Concatenator's target
+// codec, sample rate, and channel count (the values ReencodeAll would
+// otherwise re-encode to) plus a bit depth that all inputs must agree on
+// (there's no configured target bit depth; a FLAC re-encode just preserves
+// whatever the first successfully probed input already has), and returns,
+// for each input in order, whether it must be re-encoded to reach that
+// target. A probe failure is treated as "needs re-encoding" rather than
+// silently matching a zero-value target.
+func (c *Concatenator) streamCopyTargets(ctx context.Context, logger *logrus.Logger, inputs []string) []bool {
+	infos := make([]probe.StreamInfo, len(inputs))
+	failed := make([]bool, len(inputs))
+	bitDepth := -1
+	for i, input := range inputs {
+		info, err := probe.ProbeStream(ctx, input)
+		if err != nil {
+			logger.Warnf("Failed to probe %s, it will be re-encoded: %v", input, err)
+			failed[i] = true
+			continue
+		}
+		infos[i] = info
+		if bitDepth == -1 {
+			bitDepth = info.BitsPerSample
+		}
+	}
+
+	needsReencode := make([]bool, len(inputs))
+	for i, info := range infos {
+		needsReencode[i] = failed[i] || !streamMatchesTarget(info, c.codec(), c.sampleRate(), c.channels(), bitDepth)
+	}
+	return needsReencode
+}
+
+// streamMatchesTarget reports whether info already matches the codec,
+// sample rate, channel count, and bit depth a stream-copy concat would
+// require, meaning the file it was probed from can skip re-encoding.
+func streamMatchesTarget(info probe.StreamInfo, codec string, sampleRate, channels, bitsPerSample int) bool {
+	return info.CodecName == codec && info.SampleRate == sampleRate && info.Channels == channels && info.BitsPerSample == bitsPerSample
+}
+
+// loudnormFilter runs the first pass of ffmpeg's two-pass loudnorm filter
+// against path, targeting EBU R128 levels (I=-16, TP=-1.5, LRA=11), and
+// returns the -af value for the second pass that actually applies the
+// normalization using the measured values.
+func (c *Concatenator) loudnormFilter(ctx context.Context, path string) (string, error) {
+	const target = "I=-16:TP=-1.5:LRA=11"
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-i", path, "-af", "loudnorm="+target+":print_format=json", "-f", "null", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	// ffmpeg writes the JSON measurement to stderr and still exits 0 even
+	// though -f null produces no real output; errors here mean the input
+	// itself is broken, which the second pass will also fail on.
+	_ = cmd.Run()
+
+	filter, err := parseLoudnormMeasurement(target, stderr.String())
+	if err != nil {
+		return "", fmt.Errorf("%w for %s", err, path)
+	}
+	return filter, nil
+}
+
+// parseLoudnormMeasurement extracts the JSON object ffmpeg's loudnorm filter
+// writes to stderr during its first pass and turns it into the -af value
+// for the second, normalizing pass.
+func parseLoudnormMeasurement(target, ffmpegStderr string) (string, error) {
+	start := strings.LastIndex(ffmpegStderr, "{")
+	end := strings.LastIndex(ffmpegStderr, "}")
+	if start == -1 || end == -1 || end < start {
+		return "", fmt.Errorf("failed to find loudnorm measurement in ffmpeg output")
+	}
+
+	var measured struct {
+		InputI      string `json:"input_i"`
+		InputTP     string `json:"input_tp"`
+		InputLRA    string `json:"input_lra"`
+		InputThresh string `json:"input_thresh"`
+	}
+	if err := json.Unmarshal([]byte(ffmpegStderr[start:end+1]), &measured); err != nil {
+		return "", fmt.Errorf("failed to parse loudnorm measurement: %w", err)
+	}
+
+	return fmt.Sprintf("loudnorm=%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:linear=true",
+		target, measured.InputI, measured.InputTP, measured.InputLRA, measured.InputThresh), nil
+}
+
+// ReencodeAll converts each input to the Concatenator's target codec,
+// sample rate, and channel layout, skipping inputs that already match the
+// stream-copy target unless ForceReencode is set. Results are written into
+// a slice indexed by each input's original position so concat order is
+// preserved regardless of completion order. On the first worker error, ctx
+// is canceled, which kills any ffmpeg processes still running via their
+// exec.CommandContext. Re-encoded files are written to a temporary
+// directory tracked on c; call Cleanup once done with the returned paths.
+func (c *Concatenator) ReencodeAll(ctx context.Context, inputs []string) ([]string, error) {
+	logger := c.logger()
+	c.emit(Event{Type: PhaseStart, Phase: "reencode", Total: int64(len(inputs))})
+
+	needsReencode := make([]bool, len(inputs))
+	if c.ForceReencode {
+		for i := range needsReencode {
+			needsReencode[i] = true
+		}
+	} else {
+		needsReencode = c.streamCopyTargets(ctx, logger, inputs)
+	}
+
+	tempDir, err := os.MkdirTemp("", "aconcat")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	c.tempDir = tempDir
+
+	outputs := make([]string, len(inputs))
+	jobs := c.Jobs
+	if jobs <= 0 {
+		jobs = 1
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, jobs)
+
+	for i, input := range inputs {
+		absPath, err := filepath.Abs(input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get absolute path for %s: %w", input, err)
+		}
+
+		if !needsReencode[i] {
+			logger.Infof("%s already matches the stream-copy target, skipping re-encode", absPath)
+			outputs[i] = absPath
+			c.emit(Event{Type: FileDone, Phase: "reencode", File: absPath})
+			continue
+		}
+
+		i, absPath := i, absPath
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			convertedFile := filepath.Join(tempDir, fmt.Sprintf("%d_%s_converted.%s", i, filepath.Base(absPath), c.codec()))
+			logger.Infof("Re-encoding %s to %s", absPath, convertedFile)
+
+			args := []string{"-i", absPath}
+			if c.Normalize {
+				filter, err := c.loudnormFilter(ctx, absPath)
+				if err != nil {
+					return err
+				}
+				args = append(args, "-af", filter)
+			}
+			args = append(args, "-ar", strconv.Itoa(c.sampleRate()), "-ac", strconv.Itoa(c.channels()),
+				"-c:a", c.codec(), convertedFile)
+
+			durationUs, err := probe.ProbeDurationUs(ctx, absPath)
+			if err != nil {
+				logger.Warnf("Failed to probe duration for %s, progress for it will be indeterminate: %v", absPath, err)
+			}
+
+			if err := c.runFFmpeg(ctx, "reencode", absPath, durationUs, args); err != nil {
+				return fmt.Errorf("ffmpeg failed to re-encode %s: %w", absPath, err)
+			}
+
+			outputs[i] = convertedFile
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	return outputs, nil
+}
+
+// writeChaptersFile probes the duration of each file and writes an
+// ffmetadata file with one [CHAPTER] block per boundary, in the format
+// ffmpeg expects for -map_chapters. The caller is responsible for removing
+// the returned path.
+func writeChaptersFile(ctx context.Context, files []string, titles map[string]string) (string, error) {
+	durationsUs := make([]int64, len(files))
+	for i, file := range files {
+		durationUs, err := probe.ProbeDurationUs(ctx, file)
+		if err != nil {
+			return "", fmt.Errorf("failed to probe duration for chapter boundary %s: %w", file, err)
+		}
+		durationsUs[i] = durationUs
+	}
+
+	chaptersFile, err := os.CreateTemp("", "chapters-*.txt")
+	if err != nil {
+		return "", fmt.Errorf("failed to create chapters file: %w", err)
+	}
+	defer chaptersFile.Close()
+
+	if _, err := chaptersFile.WriteString(chaptersBody(files, durationsUs, titles)); err != nil {
+		return "", fmt.Errorf("failed to write chapters file: %w", err)
+	}
+
+	return chaptersFile.Name(), nil
+}
+
+// chaptersBody builds the ffmetadata body for writeChaptersFile: one
+// [CHAPTER] block per file, with boundaries derived from durationsUs (one
+// entry per file, in microseconds) and titles falling back to the file's
+// base name when titles has no override for it.
+func chaptersBody(files []string, durationsUs []int64, titles map[string]string) string {
+	var body strings.Builder
+	body.WriteString(";FFMETADATA1\n")
+
+	var startMs int64
+	for i, file := range files {
+		endMs := startMs + durationsUs[i]/1000
+
+		title := titles[file]
+		if title == "" {
+			title = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		}
+
+		fmt.Fprintf(&body, "[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%s\n", startMs, endMs, escapeFFMetadata(title))
+		startMs = endMs
+	}
+
+	return body.String()
+}
+
+// ffMetadataEscaper escapes the characters the ffmetadata format requires
+// to be backslash-escaped inside a value: '=', ';', '#', '\', and newlines.
+var ffMetadataEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`=`, `\=`,
+	`;`, `\;`,
+	`#`, `\#`,
+	"\n", `\`+"\n",
+)
+
+// escapeFFMetadata escapes s for safe use as an ffmetadata value, e.g. the
+// title in a [CHAPTER] block.
+func escapeFFMetadata(s string) string {
+	return ffMetadataEscaper.Replace(s)
+}
+
+// Concat demuxes files, which must already share a common stream layout
+// (see ReencodeAll), via ffmpeg's concat demuxer and writes the result to
+// out. If Chapters is set, one chapter is added per file boundary, using
+// ChapterTitles (keyed by the entries in files) for titles where present.
+func (c *Concatenator) Concat(ctx context.Context, files []string, out string) error {
+	logger := c.logger()
+
+	listFile, err := os.CreateTemp("", "concat-list-*.txt")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(listFile.Name())
+
+	for _, file := range files {
+		if _, err := fmt.Fprintf(listFile, "file '%s'\n", file); err != nil {
+			return fmt.Errorf("failed to write to concat list: %w", err)
+		}
+	}
+	listFile.Close()
+
+	args := []string{"-f", "concat", "-safe", "0", "-i", listFile.Name()}
+
+	if c.Chapters {
+		chaptersFile, err := writeChaptersFile(ctx, files, c.ChapterTitles)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(chaptersFile)
+		args = append(args, "-i", chaptersFile, "-map_metadata", "1", "-map_chapters", "1")
+	}
+	args = append(args, "-c", "copy", out)
+
+	var totalUs int64
+	for _, file := range files {
+		if d, err := probe.ProbeDurationUs(ctx, file); err == nil {
+			totalUs += d
+		} else {
+			totalUs = 0
+			break
+		}
+	}
+
+	logger.Info("Running ffmpeg to concatenate files.")
+	c.emit(Event{Type: PhaseStart, Phase: "concat", Total: totalUs})
+	if err := c.runFFmpeg(ctx, "concat", out, totalUs, args); err != nil {
+		return fmt.Errorf("ffmpeg failed to concatenate files: %w", err)
+	}
+
+	return nil
+}
+
+// crossfadeConcat joins files with an acrossfade of Crossfade's duration
+// between each consecutive pair, instead of the concat demuxer's hard cut.
+// This requires decoding every input in a single ffmpeg invocation, so it
+// is incompatible with the stream-copy fast path and with Chapters.
+func (c *Concatenator) crossfadeConcat(ctx context.Context, files []string, out string) error {
+	if len(files) < 2 {
+		return fmt.Errorf("crossfade requires at least two files")
+	}
+
+	args := make([]string, 0, len(files)*2+4)
+	for _, file := range files {
+		args = append(args, "-i", file)
+	}
+
+	durationSeconds := c.Crossfade.Seconds()
+	label := "0:a"
+	filters := make([]string, 0, len(files)-1)
+	for i := 1; i < len(files); i++ {
+		next := fmt.Sprintf("a%02d", i)
+		filters = append(filters, fmt.Sprintf("[%s][%d:a]acrossfade=d=%g:c1=tri:c2=tri[%s]", label, i, durationSeconds, next))
+		label = next
+	}
+
+	args = append(args, "-filter_complex", strings.Join(filters, ";"), "-map", "["+label+"]", out)
+
+	c.logger().Info("Running ffmpeg to crossfade-concatenate files.")
+	c.emit(Event{Type: PhaseStart, Phase: "concat", Total: 0})
+	if err := c.runFFmpeg(ctx, "concat", out, 0, args); err != nil {
+		return fmt.Errorf("ffmpeg failed to crossfade files: %w", err)
+	}
+
+	return nil
+}
+
+// applyMetadata remuxes output in place, adding the Title/Artist/Album
+// tags, any tags copied from MetadataFrom, and cover art from Cover. It is
+// a no-op if none of those fields are set.
+func (c *Concatenator) applyMetadata(ctx context.Context, output string) error {
+	if c.Title == "" && c.Artist == "" && c.Album == "" && c.Cover == "" && c.MetadataFrom == "" {
+		return nil
+	}
+
+	tags := map[string]string{}
+	if c.MetadataFrom != "" {
+		sourceTags, err := probe.ProbeTags(ctx, c.MetadataFrom)
+		if err != nil {
+			return fmt.Errorf("failed to read tags from %s: %w", c.MetadataFrom, err)
+		}
+		for k, v := range sourceTags {
+			tags[k] = v
+		}
+	}
+	if c.Title != "" {
+		tags["title"] = c.Title
+	}
+	if c.Artist != "" {
+		tags["artist"] = c.Artist
+	}
+	if c.Album != "" {
+		tags["album"] = c.Album
+	}
+
+	args := []string{"-y", "-i", output}
+	if c.Cover != "" {
+		args = append(args, "-i", c.Cover, "-map", "0", "-map", "1:v", "-disposition:v", "attached_pic")
+	} else {
+		args = append(args, "-map", "0")
+	}
+	args = append(args, "-c", "copy")
+	for key, value := range tags {
+		args = append(args, "-metadata", fmt.Sprintf("%s=%s", key, value))
+	}
+
+	tagged := output + ".tagged" + filepath.Ext(output)
+	args = append(args, tagged)
+
+	c.logger().Infof("Embedding metadata into %s", output)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg failed to embed metadata into %s: %w: %s", output, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return os.Rename(tagged, output)
+}
+
+// Run re-encodes inputs, concatenates them to out, converts to out's
+// extension if it differs from the intermediate codec, and embeds metadata
+// and chapters. It is the convenience entry point most callers want; use
+// ReencodeAll and Concat directly for finer-grained control.
+func (c *Concatenator) Run(ctx context.Context, inputs []string, out string) error {
+	if c.Crossfade > 0 || c.Normalize {
+		// Both modes need every input individually decoded and filtered, so
+		// the stream-copy fast path doesn't apply.
+		c.ForceReencode = true
+	}
+	if c.Crossfade > 0 && c.Chapters {
+		c.logger().Warn("Chapters are not supported with crossfade concat and will be skipped")
+	}
+
+	files, err := c.ReencodeAll(ctx, inputs)
+	defer c.Cleanup()
+	if err != nil {
+		return err
+	}
+
+	if c.Chapters && len(c.ChapterTitles) > 0 {
+		// ChapterTitles is keyed by the original input paths, but Concat
+		// looks titles up by the post-ReencodeAll file paths; remap for the
+		// duration of this call and restore it afterwards.
+		original := c.ChapterTitles
+		remapped := make(map[string]string, len(original))
+		for i, input := range inputs {
+			if title, ok := original[input]; ok {
+				remapped[files[i]] = title
+			}
+		}
+		c.ChapterTitles = remapped
+		defer func() { c.ChapterTitles = original }()
+	}
+
+	flacFile := strings.TrimSuffix(out, filepath.Ext(out)) + "." + c.codec()
+	if c.Crossfade > 0 {
+		if err := c.crossfadeConcat(ctx, files, flacFile); err != nil {
+			return err
+		}
+	} else if err := c.Concat(ctx, files, flacFile); err != nil {
+		return err
+	}
+
+	finalOutput := flacFile
+	if strings.ToLower(filepath.Ext(out)) != "."+c.codec() {
+		finalOutput = out
+		c.logger().Infof("Re-encoding %s to %s", flacFile, finalOutput)
+
+		durationUs, err := probe.ProbeDurationUs(ctx, flacFile)
+		if err != nil {
+			c.logger().Warnf("Failed to probe duration for %s: %v", flacFile, err)
+		}
+		c.emit(Event{Type: PhaseStart, Phase: "convert", Total: durationUs})
+		if err := c.runFFmpeg(ctx, "convert", finalOutput, durationUs, []string{"-i", flacFile, finalOutput}); err != nil {
+			return fmt.Errorf("ffmpeg failed to re-encode to %s: %w", finalOutput, err)
+		}
+		os.Remove(flacFile)
+	}
+
+	return c.applyMetadata(ctx, finalOutput)
+}
@@ -0,0 +1,150 @@
+package aconcat
+
+import (
+	"testing"
+
+	"github.com/walker84837/aconcat/internal/probe"
+)
+
+func TestStreamMatchesTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		info     probe.StreamInfo
+		codec    string
+		rate     int
+		chans    int
+		bitDepth int
+		expect   bool
+	}{
+		{
+			name:     "matches",
+			info:     probe.StreamInfo{CodecName: "flac", SampleRate: 48000, Channels: 2, BitsPerSample: 16},
+			codec:    "flac",
+			rate:     48000,
+			chans:    2,
+			bitDepth: 16,
+			expect:   true,
+		},
+		{
+			name:     "codec mismatch",
+			info:     probe.StreamInfo{CodecName: "mp3", SampleRate: 48000, Channels: 2, BitsPerSample: 16},
+			codec:    "flac",
+			rate:     48000,
+			chans:    2,
+			bitDepth: 16,
+			expect:   false,
+		},
+		{
+			name:     "sample rate mismatch",
+			info:     probe.StreamInfo{CodecName: "flac", SampleRate: 44100, Channels: 2, BitsPerSample: 16},
+			codec:    "flac",
+			rate:     48000,
+			chans:    2,
+			bitDepth: 16,
+			expect:   false,
+		},
+		{
+			name:     "channel mismatch",
+			info:     probe.StreamInfo{CodecName: "flac", SampleRate: 48000, Channels: 1, BitsPerSample: 16},
+			codec:    "flac",
+			rate:     48000,
+			chans:    2,
+			bitDepth: 16,
+			expect:   false,
+		},
+		{
+			name:     "bit depth mismatch",
+			info:     probe.StreamInfo{CodecName: "flac", SampleRate: 48000, Channels: 2, BitsPerSample: 24},
+			codec:    "flac",
+			rate:     48000,
+			chans:    2,
+			bitDepth: 16,
+			expect:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := streamMatchesTarget(tt.info, tt.codec, tt.rate, tt.chans, tt.bitDepth)
+			if got != tt.expect {
+				t.Errorf("streamMatchesTarget(%+v, %q, %d, %d, %d) = %v, want %v", tt.info, tt.codec, tt.rate, tt.chans, tt.bitDepth, got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestChaptersBody(t *testing.T) {
+	files := []string{"/music/01 Intro.flac", "/music/track2.flac"}
+	durationsUs := []int64{2_500_000, 3_000_000}
+	titles := map[string]string{"/music/track2.flac": "Verse"}
+
+	got := chaptersBody(files, durationsUs, titles)
+	want := ";FFMETADATA1\n" +
+		"[CHAPTER]\nTIMEBASE=1/1000\nSTART=0\nEND=2500\ntitle=01 Intro\n" +
+		"[CHAPTER]\nTIMEBASE=1/1000\nSTART=2500\nEND=5500\ntitle=Verse\n"
+
+	if got != want {
+		t.Errorf("chaptersBody() = %q, want %q", got, want)
+	}
+}
+
+func TestChaptersBodyEscapesTitles(t *testing.T) {
+	files := []string{"/music/track#3.mp3"}
+	durationsUs := []int64{1_000_000}
+	titles := map[string]string{"/music/track#3.mp3": `a=b;c\d`}
+
+	got := chaptersBody(files, durationsUs, titles)
+	want := ";FFMETADATA1\n" +
+		`[CHAPTER]` + "\nTIMEBASE=1/1000\nSTART=0\nEND=1000\n" + `title=a\=b\;c\\d` + "\n"
+
+	if got != want {
+		t.Errorf("chaptersBody() = %q, want %q", got, want)
+	}
+}
+
+func TestChaptersBodyEscapesFallbackTitle(t *testing.T) {
+	files := []string{"/music/track#3.mp3"}
+	durationsUs := []int64{1_000_000}
+
+	got := chaptersBody(files, durationsUs, nil)
+	want := ";FFMETADATA1\n" + `[CHAPTER]` + "\nTIMEBASE=1/1000\nSTART=0\nEND=1000\n" + `title=track\#3` + "\n"
+
+	if got != want {
+		t.Errorf("chaptersBody() = %q, want %q", got, want)
+	}
+}
+
+func TestParseLoudnormMeasurement(t *testing.T) {
+	const target = "I=-16:TP=-1.5:LRA=11"
+
+	stderr := `[Parsed_loudnorm_0 @ 0x0]
+{
+	"input_i" : "-23.50",
+	"input_tp" : "-6.10",
+	"input_lra" : "7.20",
+	"input_thresh" : "-33.60",
+	"output_i" : "-16.00",
+	"output_tp" : "-1.50",
+	"output_lra" : "7.00",
+	"output_thresh" : "-26.10",
+	"normalization_type" : "dynamic",
+	"target_offset" : "0.00"
+}
+`
+
+	filter, err := parseLoudnormMeasurement(target, stderr)
+	if err != nil {
+		t.Fatalf("parseLoudnormMeasurement() error = %v", err)
+	}
+
+	const want = "loudnorm=I=-16:TP=-1.5:LRA=11:measured_I=-23.50:measured_TP=-6.10:measured_LRA=7.20:measured_thresh=-33.60:linear=true"
+	if filter != want {
+		t.Errorf("parseLoudnormMeasurement() = %q, want %q", filter, want)
+	}
+}
+
+func TestParseLoudnormMeasurementNoJSON(t *testing.T) {
+	if _, err := parseLoudnormMeasurement("I=-16:TP=-1.5:LRA=11", "ffmpeg version ... no measurement here"); err == nil {
+		t.Error("parseLoudnormMeasurement() expected error for output with no JSON object, got nil")
+	}
+}